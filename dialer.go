@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/proxy"
+)
+
+// dialReprobeInterval is how long a (dialer, target) pair is left alone
+// after tripping the failure threshold before we let one dial through
+// again, so a transport that recovers (e.g. a bastion coming back up)
+// doesn't stay blacklisted forever.
+const dialReprobeInterval = 1 * time.Minute
+
+// Dialer is the minimal transport attack() needs to reach a target. The
+// default is a plain *net.Dialer (direct outbound TCP); -attack-socks and
+// -attack-via substitute one that launders the connection through a SOCKS
+// proxy or an SSH bastion, so tests can also substitute a fake transport.
+type Dialer interface {
+	Dial(network, address string) (net.Conn, error)
+}
+
+// newBastionDialer opens an SSH connection to via (a "ssh://user@host:port"
+// URL) authenticating with the private key at keyFile, and returns a Dialer
+// that tunnels outbound connections through it via client.Dial, so replay
+// traffic can reach targets on a segmented network.
+func newBastionDialer(via, keyFile string) (Dialer, error) {
+	u, err := url.Parse(via)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: malformed -attack-via URL %q: %s", via, err)
+	}
+	if u.Scheme != "ssh" {
+		return nil, fmt.Errorf("ERROR: -attack-via only supports ssh:// URLs, got %q", via)
+	}
+	user := "root"
+	if u.User != nil {
+		user = u.User.Username()
+	}
+	host := u.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "22")
+	}
+
+	signer, err := prepareHostKey(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: unable to load -attack-proxy-key %s: %s", keyFile, err)
+	}
+
+	cConfig := &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	client, err := ssh.Dial("tcp", host, cConfig)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: unable to connect to bastion %s: %s", host, err)
+	}
+	return client, nil
+}
+
+// newSocksDialer returns a Dialer that reaches targets through the SOCKS5
+// proxy listening on addr.
+func newSocksDialer(addr string) (Dialer, error) {
+	d, err := proxy.SOCKS5("tcp", addr, nil, proxy.Direct)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: unable to set up SOCKS dialer for %s: %s", addr, err)
+	}
+	return d, nil
+}
+
+// dialTracker counts consecutive dial failures per (dialer, target) pair,
+// rather than per attacked host. Each pair is blacklisted on its own after 3
+// consecutive failures; failures are not pooled across targets that share a
+// dialer. Once blacklisted, a pair is periodically re-probed
+// (dialReprobeInterval), so targets behind a broken bastion or SOCKS proxy
+// that recovers are tried again instead of staying blocked for good.
+type dialTracker struct {
+	mu          sync.Mutex
+	fails       map[string]int
+	warned      map[string]bool
+	lastAttempt map[string]time.Time
+}
+
+func newDialTracker() *dialTracker {
+	return &dialTracker{
+		fails:       make(map[string]int),
+		warned:      make(map[string]bool),
+		lastAttempt: make(map[string]time.Time),
+	}
+}
+
+func dialTrackerKey(tag, target string) string {
+	return tag + "|" + target
+}
+
+// record updates the consecutive-failure count for tag/target; a success
+// resets it and clears the blacklist.
+func (t *dialTracker) record(tag, target string, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	k := dialTrackerKey(tag, target)
+	t.lastAttempt[k] = time.Now()
+	if ok {
+		t.fails[k] = 0
+		t.warned[k] = false
+		return
+	}
+	t.fails[k]++
+}
+
+// tooManyFailures reports whether tag/target has failed 3 times in a row,
+// logging once the first time the threshold is crossed. Once
+// dialReprobeInterval has passed since the last attempt it returns false
+// for one attempt, so a recovered dialer/target gets re-tried instead of
+// staying blacklisted indefinitely.
+func (t *dialTracker) tooManyFailures(tag, target string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	k := dialTrackerKey(tag, target)
+	if t.fails[k] < 3 {
+		return false
+	}
+	if time.Since(t.lastAttempt[k]) >= dialReprobeInterval {
+		return false // let one attempt through to see if the pair recovered.
+	}
+	if !t.warned[k] {
+		t.warned[k] = true
+		log.Printf("NOT attacking %s via %s: too many network failures.\n", target, tag)
+	}
+	return true
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"log"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ctxKey is an unexported type for context.Context keys owned by this file,
+// following the standard library's advice to avoid collisions.
+type ctxKey int
+
+const handshakeInfoKey ctxKey = 0
+
+// pubKeyInfo records everything we want to keep about a public key an
+// attacker offered, since ssh.PublicKey itself isn't JSON-marshalable.
+type pubKeyInfo struct {
+	Type   string `json:"type"`
+	MD5    string `json:"md5"`
+	SHA256 string `json:"sha256"`
+	Wire   string `json:"wire_base64"`
+}
+
+// handshakeInfo accumulates everything about one connection's SSH handshake
+// that ssh.ServerConn normally discards: the raw KEXINIT offer and any
+// public keys presented during auth. handle() hands it directly to the
+// peeking reader, auth callbacks find it through connRegistry, and a
+// context.Context carries it on to serveConn and the session handlers.
+type handshakeInfo struct {
+	ConnID        string
+	ClientVersion string
+	KexAlgorithms []string
+	HostKeyAlgos  []string
+	CiphersC2S    []string
+	CiphersS2C    []string
+	MACsC2S       []string
+	MACsS2C       []string
+	CompC2S       []string
+	CompS2C       []string
+
+	mu      sync.Mutex
+	PubKeys []pubKeyInfo
+	emitted bool
+}
+
+// pickNegotiated returns the first algorithm in offered (the client's
+// preference order) that also appears in supported (the server's), which is
+// how SSH picks an algorithm for a given category per RFC 4253 7.1.
+func pickNegotiated(offered, supported []string) string {
+	supportedSet := make(map[string]bool, len(supported))
+	for _, s := range supported {
+		supportedSet[s] = true
+	}
+	for _, o := range offered {
+		if supportedSet[o] {
+			return o
+		}
+	}
+	return ""
+}
+
+func withHandshakeInfo(ctx context.Context, info *handshakeInfo) context.Context {
+	return context.WithValue(ctx, handshakeInfoKey, info)
+}
+
+func handshakeInfoFrom(ctx context.Context) *handshakeInfo {
+	info, _ := ctx.Value(handshakeInfoKey).(*handshakeInfo)
+	return info
+}
+
+func (h *handshakeInfo) addPubKey(key ssh.PublicKey) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.PubKeys = append(h.PubKeys, pubKeyInfo{
+		Type:   key.Type(),
+		MD5:    ssh.FingerprintLegacyMD5(key),
+		SHA256: ssh.FingerprintSHA256(key),
+		Wire:   base64.StdEncoding.EncodeToString(key.Marshal()),
+	})
+}
+
+// connRegistry maps a connection's RemoteAddr().String() (host:port, unique
+// per TCP connection) to its handshakeInfo, so ssh.ServerConfig callbacks -
+// which only receive an ssh.ConnMetadata, not our context.Context - can find
+// the struct that the peeking reader is filling in for the same connection.
+var connRegistry sync.Map // string -> *handshakeInfo
+
+func registerHandshakeInfo(addr string, info *handshakeInfo) {
+	connRegistry.Store(addr, info)
+}
+
+func unregisterHandshakeInfo(addr string) {
+	connRegistry.Delete(addr)
+}
+
+func handshakeInfoForConn(conn ssh.ConnMetadata) *handshakeInfo {
+	info, _ := connRegistry.Load(conn.RemoteAddr().String())
+	i, _ := info.(*handshakeInfo)
+	return i
+}
+
+// peekConn wraps a net.Conn and tees every byte read through it into a
+// buffer until it has parsed the cleartext version banner and the first
+// KEXINIT packet the client sends, so we can log what algorithms an
+// attacker's client offered even though ssh.NewServerConn never exposes it.
+type peekConn struct {
+	net.Conn
+	info *handshakeInfo
+
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	done   bool
+	gotVer bool
+	verLen int
+}
+
+func newPeekConn(c net.Conn, info *handshakeInfo) *peekConn {
+	return &peekConn{Conn: c, info: info}
+}
+
+func (p *peekConn) Read(b []byte) (int, error) {
+	n, err := p.Conn.Read(b)
+	if n > 0 {
+		p.feed(b[:n])
+	}
+	return n, err
+}
+
+func (p *peekConn) feed(b []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done {
+		return
+	}
+	p.buf.Write(b)
+
+	if !p.gotVer {
+		data := p.buf.Bytes()
+		idx := bytes.Index(data, []byte("\r\n"))
+		if idx < 0 {
+			// guard against a client that never sends a terminated banner.
+			if p.buf.Len() > 1024 {
+				p.done = true
+			}
+			return
+		}
+		p.gotVer = true
+		p.verLen = idx + 2
+		p.info.ClientVersion = string(data[:idx])
+	}
+
+	data := p.buf.Bytes()[p.verLen:]
+	if len(data) < 4 {
+		return
+	}
+	packetLen := int(data[0])<<24 | int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+	if packetLen <= 0 || packetLen > 35000 {
+		p.done = true // not a plausible KEXINIT, give up quietly.
+		return
+	}
+	if len(data) < 4+packetLen {
+		return
+	}
+	p.parseKexInit(data[4 : 4+packetLen])
+	p.done = true
+}
+
+// parseKexInit decodes the body of an SSH_MSG_KEXINIT packet (everything
+// after packet_length) per RFC 4253 7.1: padding_length(1), msg code(1)=20,
+// cookie(16), then ten name-lists, a boolean, and a reserved uint32,
+// followed by the padding it strips off.
+func (p *peekConn) parseKexInit(packet []byte) {
+	if len(packet) < 1 {
+		return
+	}
+	paddingLen := int(packet[0])
+	payload := packet[1:]
+	if len(payload) <= paddingLen {
+		return
+	}
+	payload = payload[:len(payload)-paddingLen]
+	if len(payload) < 1+16 || payload[0] != 20 {
+		return
+	}
+	off := 1 + 16 // msg code + cookie
+	lists := make([][]string, 0, 10)
+	for i := 0; i < 10; i++ {
+		list, next, ok := readNameList(payload, off)
+		if !ok {
+			return
+		}
+		lists = append(lists, list)
+		off = next
+	}
+	p.info.KexAlgorithms = lists[0]
+	p.info.HostKeyAlgos = lists[1]
+	p.info.CiphersC2S = lists[2]
+	p.info.CiphersS2C = lists[3]
+	p.info.MACsC2S = lists[4]
+	p.info.MACsS2C = lists[5]
+	p.info.CompC2S = lists[6]
+	p.info.CompS2C = lists[7]
+}
+
+// readNameList decodes one uint32-length-prefixed comma-separated name-list
+// starting at off, returning the split list and the offset just past it.
+func readNameList(b []byte, off int) ([]string, int, bool) {
+	if off+4 > len(b) {
+		return nil, 0, false
+	}
+	n := int(b[off])<<24 | int(b[off+1])<<16 | int(b[off+2])<<8 | int(b[off+3])
+	off += 4
+	if n < 0 || off+n > len(b) {
+		return nil, 0, false
+	}
+	s := string(b[off : off+n])
+	off += n
+	if s == "" {
+		return nil, off, true
+	}
+	return splitComma(s), off, true
+}
+
+func splitComma(s string) []string {
+	var out []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == ',' {
+			out = append(out, s[start:i])
+			start = i + 1
+		}
+	}
+	out = append(out, s[start:])
+	return out
+}
+
+func handshakeFields(h *handshakeInfo, serverCfg ssh.Config) map[string]interface{} {
+	return map[string]interface{}{
+		"conn_id":               h.ConnID,
+		"client_version":        h.ClientVersion,
+		"kex_algorithms":        h.KexAlgorithms,
+		"host_key_algos":        h.HostKeyAlgos,
+		"ciphers_c2s":           h.CiphersC2S,
+		"ciphers_s2c":           h.CiphersS2C,
+		"macs_c2s":              h.MACsC2S,
+		"macs_s2c":              h.MACsS2C,
+		"compress_c2s":          h.CompC2S,
+		"compress_s2c":          h.CompS2C,
+		"pubkeys":               h.PubKeys,
+		"negotiated_kex":        pickNegotiated(h.KexAlgorithms, serverCfg.KeyExchanges),
+		"negotiated_cipher_c2s": pickNegotiated(h.CiphersC2S, serverCfg.Ciphers),
+		"negotiated_cipher_s2c": pickNegotiated(h.CiphersS2C, serverCfg.Ciphers),
+		"negotiated_mac_c2s":    pickNegotiated(h.MACsC2S, serverCfg.MACs),
+		"negotiated_mac_s2c":    pickNegotiated(h.MACsS2C, serverCfg.MACs),
+		// x/crypto/ssh never negotiates anything but "none" for compression.
+		"negotiated_compress_c2s": "none",
+		"negotiated_compress_s2c": "none",
+	}
+}
+
+// emitHandshakeOnce logs the handshake JSON event the first time it's called
+// for a given connection. It must be called at connection close, not from
+// BannerCallback: that fires after key exchange but before authentication,
+// so h.PubKeys (filled in by PublicKeyCallback) would still be empty.
+// serverCfg should already have SetDefaults applied so the
+// unfilled-in-Config case still yields real negotiated algorithm names.
+func emitHandshakeOnce(addr string, h *handshakeInfo, sink *jsonSink, serverCfg ssh.Config) {
+	h.mu.Lock()
+	fire := !h.emitted
+	h.emitted = true
+	h.mu.Unlock()
+	if !fire {
+		return
+	}
+	log.Printf("%s (%s): handshake kex=%v ciphers=%v macs=%v pubkeys=%d\n",
+		addr, h.ClientVersion, h.KexAlgorithms, h.CiphersC2S, h.MACsC2S, len(h.PubKeys))
+	sink.emit("handshake", handshakeFields(h, serverCfg))
+}
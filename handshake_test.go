@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSplitComma(t *testing.T) {
+	cases := []struct {
+		in   string
+		want []string
+	}{
+		{"", []string{""}},
+		{"curve25519-sha256", []string{"curve25519-sha256"}},
+		{"a,b,c", []string{"a", "b", "c"}},
+		{"a,,b", []string{"a", "", "b"}},
+		{",", []string{"", ""}},
+	}
+	for _, c := range cases {
+		got := splitComma(c.in)
+		if !equalStrings(got, c.want) {
+			t.Errorf("splitComma(%q) = %v, want %v", c.in, got, c.want)
+		}
+	}
+}
+
+func TestReadNameList(t *testing.T) {
+	cases := []struct {
+		name    string
+		b       []byte
+		off     int
+		wantOK  bool
+		want    []string
+		wantOff int
+	}{
+		{
+			name:   "too short for length prefix",
+			b:      []byte{0, 0, 0},
+			off:    0,
+			wantOK: false,
+		},
+		{
+			name:   "length prefix past end of buffer",
+			b:      []byte{0, 0, 0, 10, 'a', 'b'},
+			off:    0,
+			wantOK: false,
+		},
+		{
+			name:   "maximal length prefix overflows the buffer",
+			b:      append([]byte{0xff, 0xff, 0xff, 0xff}, "x"...),
+			off:    0,
+			wantOK: false,
+		},
+		{
+			name:    "zero-length name-list",
+			b:       []byte{0, 0, 0, 0},
+			off:     0,
+			wantOK:  true,
+			want:    nil,
+			wantOff: 4,
+		},
+		{
+			name:    "single algorithm",
+			b:       append([]byte{0, 0, 0, 17}, "curve25519-sha256"...),
+			off:     0,
+			wantOK:  true,
+			want:    []string{"curve25519-sha256"},
+			wantOff: 21,
+		},
+		{
+			name:    "comma separated list at a non-zero offset",
+			b:       append([]byte{'X', 'X', 0, 0, 0, 3}, "a,b"...),
+			off:     2,
+			wantOK:  true,
+			want:    []string{"a", "b"},
+			wantOff: 9,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, off, ok := readNameList(c.b, c.off)
+			if ok != c.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, c.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if !equalStrings(got, c.want) {
+				t.Errorf("list = %v, want %v", got, c.want)
+			}
+			if off != c.wantOff {
+				t.Errorf("off = %d, want %d", off, c.wantOff)
+			}
+		})
+	}
+}
+
+// buildKexInit assembles the payload of an SSH_MSG_KEXINIT packet (RFC 4253
+// 7.1: msg code, 16-byte cookie, ten name-lists, first_kex_packet_follows,
+// reserved uint32) from ten name-lists, for use as parseKexInit test input.
+func buildKexInit(lists [10][]string) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(20) // SSH_MSG_KEXINIT
+	buf.Write(make([]byte, 16))
+	for _, l := range lists {
+		s := ""
+		for i, a := range l {
+			if i > 0 {
+				s += ","
+			}
+			s += a
+		}
+		n := len(s)
+		buf.Write([]byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)})
+		buf.WriteString(s)
+	}
+	buf.WriteByte(0)           // first_kex_packet_follows = false
+	buf.Write(make([]byte, 4)) // reserved
+	return buf.Bytes()
+}
+
+// wrapKexInitPacket wraps a KEXINIT payload in the SSH binary packet framing
+// (packet_length, padding_length, payload, padding); peekConn.feed peels off
+// packet_length and hands the rest to parseKexInit, which strips the padding.
+func wrapKexInitPacket(payload []byte, paddingLen int) []byte {
+	padded := append(append([]byte{}, payload...), make([]byte, paddingLen)...)
+	body := append([]byte{byte(paddingLen)}, padded...)
+	n := len(body)
+	packet := []byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+	return append(packet, body...)
+}
+
+func TestParseKexInit(t *testing.T) {
+	// Algorithm lists modeled on a real OpenSSH 8.9 client's KEXINIT offer.
+	real := [10][]string{
+		{"curve25519-sha256", "curve25519-sha256@libssh.org", "ecdh-sha2-nistp256"},
+		{"ssh-ed25519", "rsa-sha2-512", "rsa-sha2-256", "ssh-rsa"},
+		{"chacha20-poly1305@openssh.com", "aes128-ctr", "aes256-ctr"},
+		{"chacha20-poly1305@openssh.com", "aes128-ctr", "aes256-ctr"},
+		{"umac-64-etm@openssh.com", "hmac-sha2-256-etm@openssh.com"},
+		{"umac-64-etm@openssh.com", "hmac-sha2-256-etm@openssh.com"},
+		{"none", "zlib@openssh.com"},
+		{"none", "zlib@openssh.com"},
+		{},
+		{},
+	}
+
+	t.Run("well-formed real-world-shaped packet", func(t *testing.T) {
+		p := &peekConn{info: &handshakeInfo{}}
+		packet := wrapKexInitPacket(buildKexInit(real), 8)
+		p.parseKexInit(packet[4:]) // parseKexInit takes the packet body, not the length prefix
+		if !equalStrings(p.info.KexAlgorithms, real[0]) {
+			t.Errorf("kex = %v, want %v", p.info.KexAlgorithms, real[0])
+		}
+		if !equalStrings(p.info.HostKeyAlgos, real[1]) {
+			t.Errorf("host key algos = %v, want %v", p.info.HostKeyAlgos, real[1])
+		}
+		if !equalStrings(p.info.MACsC2S, real[4]) {
+			t.Errorf("macs c2s = %v, want %v", p.info.MACsC2S, real[4])
+		}
+	})
+
+	t.Run("empty packet", func(t *testing.T) {
+		p := &peekConn{info: &handshakeInfo{}}
+		p.parseKexInit(nil) // must not panic
+	})
+
+	t.Run("padding length consumes the whole payload", func(t *testing.T) {
+		p := &peekConn{info: &handshakeInfo{}}
+		// paddingLen says "254 bytes of padding" but the packet is tiny.
+		p.parseKexInit([]byte{254, 20, 1, 2, 3})
+		if p.info.KexAlgorithms != nil {
+			t.Errorf("expected no fields set, got kex = %v", p.info.KexAlgorithms)
+		}
+	})
+
+	t.Run("wrong message code", func(t *testing.T) {
+		p := &peekConn{info: &handshakeInfo{}}
+		payload := make([]byte, 1+16+4)
+		payload[0] = 99 // not SSH_MSG_KEXINIT
+		p.parseKexInit(append([]byte{0}, payload...))
+		if p.info.KexAlgorithms != nil {
+			t.Errorf("expected no fields set, got kex = %v", p.info.KexAlgorithms)
+		}
+	})
+
+	t.Run("truncated name-list list aborts without panicking or partially applying", func(t *testing.T) {
+		p := &peekConn{info: &handshakeInfo{}}
+		var buf bytes.Buffer
+		buf.WriteByte(20)
+		buf.Write(make([]byte, 16))
+		buf.Write([]byte{0, 0, 0, 3}) // claims 3 bytes but the packet ends here
+		p.parseKexInit(append([]byte{0}, buf.Bytes()...))
+		if p.info.KexAlgorithms != nil {
+			t.Errorf("expected no fields set, got kex = %v", p.info.KexAlgorithms)
+		}
+	})
+}
+
+func TestPeekConnFeedOversizedPacketLen(t *testing.T) {
+	p := newPeekConn(nil, &handshakeInfo{})
+	p.feed([]byte("SSH-2.0-test\r\n"))
+	if !p.gotVer {
+		t.Fatal("expected version line to be detected")
+	}
+	// A packet_length far beyond any plausible KEXINIT should make feed give
+	// up quietly rather than waiting forever for more bytes.
+	p.feed([]byte{0x00, 0xff, 0xff, 0xff})
+	if !p.done {
+		t.Error("expected peekConn to give up on an implausible packet_length")
+	}
+	if p.info.KexAlgorithms != nil {
+		t.Errorf("expected no fields set, got kex = %v", p.info.KexAlgorithms)
+	}
+}
+
+func TestPeekConnFeedRealKexInit(t *testing.T) {
+	real := [10][]string{
+		{"curve25519-sha256"},
+		{"ssh-ed25519"},
+		{"aes128-ctr"},
+		{"aes128-ctr"},
+		{"hmac-sha2-256"},
+		{"hmac-sha2-256"},
+		{"none"},
+		{"none"},
+		{},
+		{},
+	}
+	p := newPeekConn(nil, &handshakeInfo{})
+	packet := wrapKexInitPacket(buildKexInit(real), 6)
+	p.feed([]byte("SSH-2.0-OpenSSH_8.9\r\n"))
+	p.feed(packet)
+	if !p.done {
+		t.Fatal("expected peekConn to consider itself done after a full KEXINIT")
+	}
+	if !equalStrings(p.info.KexAlgorithms, real[0]) {
+		t.Errorf("kex = %v, want %v", p.info.KexAlgorithms, real[0])
+	}
+	if p.info.ClientVersion != "SSH-2.0-OpenSSH_8.9" {
+		t.Errorf("client version = %q, want %q", p.info.ClientVersion, "SSH-2.0-OpenSSH_8.9")
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
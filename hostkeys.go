@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"log"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// generateEd25519Key generates a fresh Ed25519 host key. Ed25519 keys are
+// fast to generate and, alongside RSA and ECDSA, are one of the three
+// families a stock OpenSSH install offers by default.
+func generateEd25519Key() (ssh.Signer, error) {
+	log.Printf("Generating Ed25519 private key.")
+	_, pkey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(pkey)
+	if err != nil {
+		return nil, err
+	}
+	blk := &pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: der,
+	}
+	return ssh.ParsePrivateKey(pem.EncodeToMemory(blk))
+}
+
+// generateECDSAKey generates a fresh ECDSA host key on the P-256 curve,
+// matching the curve OpenSSH's keygen defaults to for ecdsa-sha2-nistp256.
+func generateECDSAKey() (ssh.Signer, error) {
+	log.Printf("Generating ECDSA P-256 private key.")
+	pkey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(pkey)
+	if err != nil {
+		return nil, err
+	}
+	blk := &pem.Block{
+		Type:  "EC PRIVATE KEY",
+		Bytes: der,
+	}
+	return ssh.ParsePrivateKey(pem.EncodeToMemory(blk))
+}
+
+// addGeneratedHostKeys generates one host key of each of RSA, Ed25519, and
+// ECDSA and adds them to sConfig in the order preferred by order (the
+// selected algoProfile's HostKeyOrder), so a real client sees the same mix
+// of host key types a stock sshd would offer rather than the single RSA key
+// this honeypot used to present.
+func addGeneratedHostKeys(sConfig *ssh.ServerConfig, order []string) error {
+	signers := make(map[string]ssh.Signer, 3)
+
+	rsaKey, err := generateRSA_Key(DefKeyBits)
+	if err != nil {
+		return err
+	}
+	signers[rsaKey.PublicKey().Type()] = rsaKey
+
+	edKey, err := generateEd25519Key()
+	if err != nil {
+		return err
+	}
+	signers[edKey.PublicKey().Type()] = edKey
+
+	ecKey, err := generateECDSAKey()
+	if err != nil {
+		return err
+	}
+	signers[ecKey.PublicKey().Type()] = ecKey
+
+	for _, algo := range order {
+		signer, ok := signers[algo]
+		if !ok {
+			continue
+		}
+		sConfig.AddHostKey(signer)
+		log.Printf("Added host key to the configuration (%s)\n", signer.PublicKey().Type())
+		delete(signers, algo)
+	}
+	// add anything left over that wasn't named by the profile's order.
+	for _, signer := range signers {
+		sConfig.AddHostKey(signer)
+		log.Printf("Added host key to the configuration (%s)\n", signer.PublicKey().Type())
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// jsonSink emits one JSON object per line for each recorded event, in
+// addition to the free-form log.Printf output, so the honeypot's output can
+// be consumed like zgrab-style scan data.
+type jsonSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// openJSONSink opens dest ("-" for stdout) and returns a sink that appends
+// one JSON object per event.
+func openJSONSink(dest string) (*jsonSink, error) {
+	var w io.Writer
+	if dest == "-" {
+		w = os.Stdout
+	} else {
+		f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	return &jsonSink{enc: json.NewEncoder(w)}, nil
+}
+
+// emit writes one JSON object combining a timestamp, the event name, and the
+// given fields. A nil sink is a no-op so callers don't need to guard every
+// call site on whether -j was passed.
+func (j *jsonSink) emit(event string, fields map[string]interface{}) {
+	if j == nil {
+		return
+	}
+	rec := make(map[string]interface{}, len(fields)+2)
+	for k, v := range fields {
+		rec[k] = v
+	}
+	rec["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	rec["event"] = event
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.enc.Encode(rec)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+	"golang.org/x/crypto/ssh"
+)
+
+// hostKeyRecord is what we remember about the host key presented by a
+// target we replayed credentials against: the first key we ever saw from
+// it, the most recent one, and when (if ever) those diverged.
+type hostKeyRecord struct {
+	Host            string `json:"host"`
+	FirstSeenType   string `json:"first_seen_type"`
+	FirstSeenMD5    string `json:"first_seen_md5"`
+	FirstSeenSHA256 string `json:"first_seen_sha256"`
+	LastSeenType    string `json:"last_seen_type"`
+	LastSeenMD5     string `json:"last_seen_md5"`
+	LastSeenSHA256  string `json:"last_seen_sha256"`
+	ChangedAt       string `json:"changed_at,omitempty"`
+}
+
+// HostKeyStore persists the host-key mapping attack() observes when
+// replaying credentials back against an attacker's origin host.
+type HostKeyStore interface {
+	// Record notes that key was presented by host, returning the updated
+	// record and whether this key differs from the last one seen for host.
+	Record(host string, key ssh.PublicKey) (hostKeyRecord, bool, error)
+	All() ([]hostKeyRecord, error)
+	Close() error
+}
+
+func fingerprintRecord(host string, key ssh.PublicKey) hostKeyRecord {
+	return hostKeyRecord{
+		Host:            host,
+		FirstSeenType:   key.Type(),
+		FirstSeenMD5:    ssh.FingerprintLegacyMD5(key),
+		FirstSeenSHA256: ssh.FingerprintSHA256(key),
+		LastSeenType:    key.Type(),
+		LastSeenMD5:     ssh.FingerprintLegacyMD5(key),
+		LastSeenSHA256:  ssh.FingerprintSHA256(key),
+	}
+}
+
+// openHostKeyStore selects a store backend ("json" or "bolt") and opens it
+// at path, filling in a backend-appropriate default path if none is given.
+func openHostKeyStore(backend, path string) (HostKeyStore, error) {
+	switch backend {
+	case "", "json":
+		if path == "" {
+			path = "hostkeys.json"
+		}
+		return newJSONHostKeyStore(path)
+	case "bolt":
+		if path == "" {
+			path = "hostkeys.db"
+		}
+		return newBoltHostKeyStore(path)
+	default:
+		return nil, fmt.Errorf("ERROR: unknown -keystore-backend %q (want json or bolt)", backend)
+	}
+}
+
+// jsonHostKeyStore is an append-only JSON-lines log: every call to Record
+// appends the new full record for that host, and the in-memory map (loaded
+// from the log at startup) always reflects the latest one.
+type jsonHostKeyStore struct {
+	mu      sync.Mutex
+	f       *os.File
+	records map[string]hostKeyRecord
+}
+
+func newJSONHostKeyStore(path string) (*jsonHostKeyStore, error) {
+	s := &jsonHostKeyStore{records: make(map[string]hostKeyRecord)}
+
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var rec hostKeyRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err == nil {
+				s.records[rec.Host] = rec
+			}
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s.f = f
+	return s, nil
+}
+
+func (s *jsonHostKeyStore) Record(host string, key ssh.PublicKey) (hostKeyRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sha256 := ssh.FingerprintSHA256(key)
+	rec, ok := s.records[host]
+	var changed bool
+	if !ok {
+		rec = fingerprintRecord(host, key)
+	} else {
+		changed = rec.LastSeenSHA256 != sha256
+		rec.LastSeenType = key.Type()
+		rec.LastSeenMD5 = ssh.FingerprintLegacyMD5(key)
+		rec.LastSeenSHA256 = sha256
+		if changed {
+			rec.ChangedAt = time.Now().UTC().Format(time.RFC3339)
+		}
+	}
+	s.records[host] = rec
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return rec, false, err
+	}
+	if _, err := fmt.Fprintln(s.f, string(data)); err != nil {
+		return rec, false, err
+	}
+	return rec, changed, nil
+}
+
+func (s *jsonHostKeyStore) All() ([]hostKeyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]hostKeyRecord, 0, len(s.records))
+	for _, rec := range s.records {
+		out = append(out, rec)
+	}
+	return out, nil
+}
+
+func (s *jsonHostKeyStore) Close() error {
+	return s.f.Close()
+}
+
+// boltHostKeyStore keeps the same records in a BoltDB bucket instead of an
+// append-only log, for operators who'd rather not replay a growing file on
+// every restart.
+type boltHostKeyStore struct {
+	db *bbolt.DB
+}
+
+var hostKeyBucket = []byte("hostkeys")
+
+func newBoltHostKeyStore(path string) (*boltHostKeyStore, error) {
+	db, err := bbolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(hostKeyBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltHostKeyStore{db: db}, nil
+}
+
+func (s *boltHostKeyStore) Record(host string, key ssh.PublicKey) (hostKeyRecord, bool, error) {
+	var rec hostKeyRecord
+	var changed bool
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(hostKeyBucket)
+		sha256 := ssh.FingerprintSHA256(key)
+
+		if existing := b.Get([]byte(host)); existing != nil {
+			if err := json.Unmarshal(existing, &rec); err != nil {
+				return err
+			}
+			changed = rec.LastSeenSHA256 != sha256
+			rec.LastSeenType = key.Type()
+			rec.LastSeenMD5 = ssh.FingerprintLegacyMD5(key)
+			rec.LastSeenSHA256 = sha256
+			if changed {
+				rec.ChangedAt = time.Now().UTC().Format(time.RFC3339)
+			}
+		} else {
+			rec = fingerprintRecord(host, key)
+		}
+
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(host), data)
+	})
+	return rec, changed, err
+}
+
+func (s *boltHostKeyStore) All() ([]hostKeyRecord, error) {
+	var out []hostKeyRecord
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(hostKeyBucket)
+		return b.ForEach(func(k, v []byte) error {
+			var rec hostKeyRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			out = append(out, rec)
+			return nil
+		})
+	})
+	return out, err
+}
+
+func (s *boltHostKeyStore) Close() error {
+	return s.db.Close()
+}
+
+// serveStats starts an HTTP server on addr exposing the collected
+// attacker-IP -> target-host-key mapping as JSON, so external tooling can
+// join it against attacker-source data.
+func serveStats(addr string, store HostKeyStore) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hostkeys", func(w http.ResponseWriter, r *http.Request) {
+		records, err := store.All()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(records)
+	})
+	log.Printf("Serving host-key stats on %s\n", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("stats server stopped: %s\n", err)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// algoProfile describes the set of algorithms and host-key ordering a
+// particular SSH implementation advertises in its KEXINIT, so -profile can
+// make this honeypot's fingerprint look like that implementation instead of
+// the easily-recognized Go ssh package defaults.
+type algoProfile struct {
+	Name         string   `json:"name"`
+	KeyExchanges []string `json:"key_exchanges"`
+	Ciphers      []string `json:"ciphers"`
+	MACs         []string `json:"macs"`
+	HostKeyOrder []string `json:"host_key_order"`
+}
+
+// builtinProfiles is a small table of algorithm sets taken from real
+// KEXINIT captures of popular SSH server implementations, so operators can
+// pick a convincing fingerprint without having to build one themselves.
+var builtinProfiles = map[string]algoProfile{
+	"openssh-8.9": {
+		Name: "openssh-8.9",
+		KeyExchanges: []string{
+			"curve25519-sha256", "curve25519-sha256@libssh.org",
+			"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+			"diffie-hellman-group16-sha512",
+			"diffie-hellman-group18-sha512", "diffie-hellman-group14-sha256",
+		},
+		Ciphers: []string{
+			"chacha20-poly1305@openssh.com",
+			"aes128-ctr", "aes192-ctr", "aes256-ctr",
+			"aes128-gcm@openssh.com", "aes256-gcm@openssh.com",
+		},
+		MACs: []string{
+			"umac-64-etm@openssh.com", "umac-128-etm@openssh.com",
+			"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com",
+			"hmac-sha2-256", "hmac-sha2-512",
+		},
+		HostKeyOrder: []string{"ssh-ed25519", "ecdsa-sha2-nistp256", "ssh-rsa"},
+	},
+	"dropbear-2020.81": {
+		Name: "dropbear-2020.81",
+		KeyExchanges: []string{
+			"curve25519-sha256@libssh.org", "ecdh-sha2-nistp256",
+			"diffie-hellman-group14-sha256", "diffie-hellman-group14-sha1",
+		},
+		Ciphers: []string{
+			"chacha20-poly1305@openssh.com", "aes128-ctr", "aes256-ctr",
+		},
+		MACs: []string{
+			"hmac-sha2-256-etm@openssh.com", "hmac-sha1-96", "hmac-sha1",
+		},
+		HostKeyOrder: []string{"ssh-rsa", "ssh-ed25519", "ecdsa-sha2-nistp256"},
+	},
+	"libssh-0.9": {
+		Name: "libssh-0.9",
+		KeyExchanges: []string{
+			"curve25519-sha256", "curve25519-sha256@libssh.org",
+			"ecdh-sha2-nistp256", "diffie-hellman-group16-sha512",
+			"diffie-hellman-group18-sha512", "diffie-hellman-group14-sha256",
+		},
+		Ciphers: []string{
+			"chacha20-poly1305@openssh.com", "aes256-ctr", "aes128-ctr", "aes256-gcm@openssh.com",
+		},
+		MACs: []string{
+			"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com", "hmac-sha2-256",
+		},
+		HostKeyOrder: []string{"ssh-rsa", "ecdsa-sha2-nistp256", "ssh-ed25519"},
+	},
+}
+
+// defaultHostKeyOrder is used when no -profile is given. It adds the RSA key
+// first, the only host key type this honeypot used to present.
+var defaultHostKeyOrder = []string{"ssh-rsa", "ssh-ed25519", "ecdsa-sha2-nistp256"}
+
+// loadProfile resolves a -profile flag value to an algoProfile, reading it
+// from disk for "custom:<path>" (a JSON file in the same shape as the
+// builtin table).
+func loadProfile(name string) (*algoProfile, error) {
+	if name == "" {
+		return nil, nil
+	}
+	if path, ok := strings.CutPrefix(name, "custom:"); ok {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("ERROR: unable to read profile file: %s", path)
+		}
+		var p algoProfile
+		if err := json.Unmarshal(data, &p); err != nil {
+			return nil, fmt.Errorf("ERROR: malformed profile file %s: %s", path, err)
+		}
+		return &p, nil
+	}
+	p, ok := builtinProfiles[name]
+	if !ok {
+		return nil, fmt.Errorf("ERROR: unknown -profile %q", name)
+	}
+	return &p, nil
+}
+
+// serverUnsupportedKex lists key exchanges x/crypto/ssh refuses to run on
+// the server side (it rejects the whole ServerConfig if any are present in
+// Config.KeyExchanges), even though a real sshd would offer them. A profile
+// can still name them for fingerprinting purposes elsewhere; applyProfile
+// just won't hand them to the server.
+var serverUnsupportedKex = map[string]bool{
+	"diffie-hellman-group-exchange-sha1":   true,
+	"diffie-hellman-group-exchange-sha256": true,
+}
+
+func filterServerKex(kex []string) []string {
+	out := make([]string, 0, len(kex))
+	for _, k := range kex {
+		if !serverUnsupportedKex[k] {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// applyProfile reconfigures sConfig.Config to advertise p's algorithm
+// lists, so the negotiated KEX/cipher/MAC resemble the chosen real-world
+// implementation. It does not touch host keys; p.HostKeyOrder is applied
+// separately by addGeneratedHostKeys.
+func applyProfile(sConfig *ssh.ServerConfig, p *algoProfile) {
+	sConfig.Config = ssh.Config{
+		KeyExchanges: filterServerKex(p.KeyExchanges),
+		Ciphers:      p.Ciphers,
+		MACs:         p.MACs,
+	}
+}
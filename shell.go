@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const fakeUname = "Linux honeypot 4.15.0-112-generic #113-Ubuntu SMP x86_64 GNU/Linux"
+
+const fakePasswd = `root:x:0:0:root:/root:/bin/bash
+daemon:x:1:1:daemon:/usr/sbin:/usr/sbin/nologin
+bin:x:2:2:bin:/bin:/usr/sbin/nologin
+sys:x:3:3:sys:/dev:/usr/sbin/nologin
+www-data:x:33:33:www-data:/var/www:/usr/sbin/nologin
+`
+
+// connID names an accepted connection for log correlation, e.g. "1.2.3.4:5678".
+func connID(conn ssh.ConnMetadata) string {
+	return conn.RemoteAddr().String()
+}
+
+// serveConn services the channels and global requests offered over an
+// already-authenticated connection. It returns once the connection is closed.
+func serveConn(ctx context.Context, conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+	id := connID(conn)
+	go serveGlobalRequests(id, reqs)
+
+	for newChan := range chans {
+		switch newChan.ChannelType() {
+		case "session":
+			channel, requests, err := newChan.Accept()
+			if err != nil {
+				log.Printf("%s: unable to accept session channel: %s\n", id, err)
+				continue
+			}
+			jlog.emit("session_channel", map[string]interface{}{"conn_id": id})
+			go serveSession(ctx, id, channel, requests)
+		case "direct-tcpip":
+			serveDirectTCPIP(id, newChan)
+		default:
+			log.Printf("%s: rejecting unknown channel type %q\n", id, newChan.ChannelType())
+			newChan.Reject(ssh.UnknownChannelType, "unknown channel type")
+		}
+	}
+}
+
+// serveGlobalRequests logs (but never honors) global requests such as
+// tcpip-forward, which attackers use to probe whether the box can be used as
+// a scan pivot.
+func serveGlobalRequests(id string, reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		log.Printf("%s: global request %q (payload %d bytes)\n", id, req.Type, len(req.Payload))
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// serveDirectTCPIP accepts a direct-tcpip channel so attackers probing
+// whether this box can be used as a pivot see a successful channel-open
+// instead of an immediate rejection, logs the target it asked to reach, and
+// then closes the channel without relaying any traffic to it.
+func serveDirectTCPIP(id string, newChan ssh.NewChannel) {
+	destHost, destPort, origHost, origPort, ok := parseDirectTCPIP(newChan.ExtraData())
+	if !ok {
+		log.Printf("%s: rejecting malformed direct-tcpip request\n", id)
+		newChan.Reject(ssh.ConnectionFailed, "malformed direct-tcpip request")
+		return
+	}
+	log.Printf("%s: direct-tcpip pivot attempt to %s:%d (from %s:%d), accepting but not proxying\n",
+		id, destHost, destPort, origHost, origPort)
+	jlog.emit("direct_tcpip", map[string]interface{}{
+		"conn_id":   id,
+		"dest_host": destHost,
+		"dest_port": destPort,
+		"orig_host": origHost,
+		"orig_port": origPort,
+	})
+
+	channel, requests, err := newChan.Accept()
+	if err != nil {
+		log.Printf("%s: unable to accept direct-tcpip channel: %s\n", id, err)
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	channel.Close()
+}
+
+// serveSession honors the handful of channel requests a real client sends on
+// a session channel and, once a shell/exec is requested, drives a tiny fake
+// shell so we can see what the attacker tries to do.
+func serveSession(ctx context.Context, id string, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	for req := range requests {
+		switch req.Type {
+		case "pty-req":
+			log.Printf("%s: pty-req\n", id)
+			req.Reply(true, nil)
+		case "env":
+			log.Printf("%s: env %s\n", id, req.Payload)
+			req.Reply(true, nil)
+		case "shell":
+			req.Reply(true, nil)
+			fakeShell(id, channel)
+			return
+		case "exec":
+			cmd := parseSSHString(req.Payload)
+			log.Printf("%s: exec %q\n", id, cmd)
+			req.Reply(true, nil)
+			fields := map[string]interface{}{"conn_id": id, "command": cmd}
+			if h := handshakeInfoFrom(ctx); h != nil {
+				fields["pubkeys_offered"] = len(h.PubKeys)
+			}
+			jlog.emit("exec", fields)
+			fmt.Fprintln(channel, runFakeCommand(cmd))
+			channel.SendRequest("exit-status", false, []byte{0, 0, 0, 0})
+			return
+		case "subsystem":
+			name := parseSSHString(req.Payload)
+			log.Printf("%s: subsystem %q requested (not supported)\n", id, name)
+			req.Reply(false, nil)
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// parseSSHString decodes the uint32-length-prefixed string that makes up the
+// payload of exec and subsystem requests.
+func parseSSHString(payload []byte) string {
+	s, _, ok := readSSHString(payload, 0)
+	if !ok {
+		return ""
+	}
+	return s
+}
+
+// readSSHString decodes one uint32-length-prefixed string starting at off,
+// returning it along with the offset just past it.
+func readSSHString(b []byte, off int) (string, int, bool) {
+	if off+4 > len(b) {
+		return "", 0, false
+	}
+	n := int(b[off])<<24 | int(b[off+1])<<16 | int(b[off+2])<<8 | int(b[off+3])
+	off += 4
+	if n < 0 || off+n > len(b) {
+		return "", 0, false
+	}
+	return string(b[off : off+n]), off + n, true
+}
+
+// parseDirectTCPIP decodes a direct-tcpip channel-open payload per RFC 4254
+// 7.2: the host and port the client wants to reach, and the originator's
+// address and port.
+func parseDirectTCPIP(data []byte) (destHost string, destPort uint32, origHost string, origPort uint32, ok bool) {
+	destHost, off, ok := readSSHString(data, 0)
+	if !ok {
+		return
+	}
+	if off+4 > len(data) {
+		ok = false
+		return
+	}
+	destPort = uint32(data[off])<<24 | uint32(data[off+1])<<16 | uint32(data[off+2])<<8 | uint32(data[off+3])
+	off += 4
+	origHost, off, ok = readSSHString(data, off)
+	if !ok {
+		return
+	}
+	if off+4 > len(data) {
+		ok = false
+		return
+	}
+	origPort = uint32(data[off])<<24 | uint32(data[off+1])<<16 | uint32(data[off+2])<<8 | uint32(data[off+3])
+	ok = true
+	return
+}
+
+// fakeShell prints a prompt and services a small set of commands until the
+// attacker types exit or closes the channel, logging every line it reads.
+func fakeShell(id string, channel ssh.Channel) {
+	fmt.Fprint(channel, "$ ")
+	scanner := bufio.NewScanner(channel)
+	for scanner.Scan() {
+		line := scanner.Text()
+		log.Printf("%s: shell input %q\n", id, line)
+		if strings.TrimSpace(line) == "exit" {
+			return
+		}
+		fmt.Fprintln(channel, runFakeCommand(line))
+		fmt.Fprint(channel, "$ ")
+	}
+}
+
+// runFakeCommand returns canned output for the small set of commands a
+// Cowrie-style low-interaction shell is expected to understand.
+func runFakeCommand(cmd string) string {
+	fields := strings.Fields(cmd)
+	if len(fields) == 0 {
+		return ""
+	}
+	switch fields[0] {
+	case "ls":
+		return "bin  boot  etc  home  lib  root  tmp  usr  var"
+	case "uname":
+		return fakeUname
+	case "cat":
+		if len(fields) > 1 && fields[1] == "/etc/passwd" {
+			return fakePasswd
+		}
+		return fmt.Sprintf("cat: %s: No such file or directory", strings.Join(fields[1:], " "))
+	case "wget", "curl":
+		log.Printf("download attempt recorded: %s\n", cmd)
+		return fmt.Sprintf("%s: unable to resolve host address", fields[len(fields)-1])
+	case "exit":
+		return ""
+	default:
+		return fmt.Sprintf("%s: command not found", fields[0])
+	}
+}
